@@ -2,21 +2,38 @@ package ufile
 
 import (
 	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
-	"github.com/ucloud/ucloud-sdk-go/private/services/ubusinessgroup"
 	"github.com/ucloud/ucloud-sdk-go/ucloud/auth"
 	"net/url"
 	"strings"
+	"time"
 
 	"github.com/hashicorp/terraform/backend"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/version"
+	"github.com/ucloud/ucloud-sdk-go/services/kms"
 	"github.com/ucloud/ucloud-sdk-go/services/ufile"
 	"github.com/ucloud/ucloud-sdk-go/ucloud"
 	ufsdk "github.com/ufilesdk-dev/ufile-gosdk"
 )
 
+const (
+	// defaultUploadPartSize is the chunk size used to split a state file
+	// into multipart upload parts when it exceeds the part size.
+	defaultUploadPartSize = 4 << 20 // 4 MiB
+	minUploadPartSize     = 1 << 20 // 1 MiB, UFile's own minimum part size
+	// defaultUploadConcurrency bounds how many part upload workers are in
+	// flight at once. The UploadPart calls themselves are serialized (see
+	// ufileObjectStore.PutObject), so one part is sent at a time.
+	defaultUploadConcurrency = 20
+
+	// defaultLockTTLSeconds is how long a umem lock lease lasts before it
+	// must be renewed by remoteClient's heartbeat goroutine.
+	defaultLockTTLSeconds = 20
+)
+
 // New creates a new backend for ufile remote state.
 func New() backend.Backend {
 	s := &schema.Backend{
@@ -37,16 +54,16 @@ func New() backend.Backend {
 
 			"project_id": {
 				Type:        schema.TypeString,
-				Required:    true,
+				Optional:    true,
 				DefaultFunc: schema.EnvDefaultFunc("UCLOUD_PROJECT_ID", nil),
-				Description: "UCloud Project ID",
+				Description: "UCloud Project ID. Required unless driver = \"s3\", which has no notion of a UCloud project.",
 			},
 
 			"region": {
 				Type:        schema.TypeString,
-				Required:    true,
+				Optional:    true,
 				DefaultFunc: schema.EnvDefaultFunc("UCLOUD_REGION", nil),
-				Description: "The region of the UFlile bucket",
+				Description: "The region of the UFlile bucket. Required unless driver = \"s3\"; with driver = \"s3\" it is optional and, when set, is used as the region of the S3-compatible endpoint.",
 			},
 
 			"bucket": {
@@ -96,6 +113,214 @@ func New() backend.Backend {
 					return nil, nil
 				},
 			},
+
+			"driver": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "ufile",
+				Description: "The object storage driver backing this backend: \"ufile\" (the default) or \"s3\", for any S3-compatible endpoint such as a self-hosted MinIO cluster. State locking (lock_backend = \"ufile\") is only atomic on driver = \"ufile\": most S3-compatible stores have no conditional-write primitive this backend can use, so on driver = \"s3\" lock acquisition is a plain get-then-put with a race window between two racing clients. Use lock_backend = \"umem\" if you need atomic locking with driver = \"s3\".",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					driver := v.(string)
+					if driver != "ufile" && driver != "s3" {
+						return nil, []error{fmt.Errorf("%q must be one of \"ufile\" or \"s3\", got %q", k, driver)}
+					}
+					return nil, nil
+				},
+			},
+
+			"endpoint": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "The S3-compatible endpoint to use. Only applies when driver = \"s3\".",
+			},
+
+			"access_key": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("AWS_ACCESS_KEY_ID", nil),
+				Description: "The access key used to authenticate with the S3-compatible endpoint. Only applies when driver = \"s3\".",
+			},
+
+			"secret_key": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Sensitive:   true,
+				DefaultFunc: schema.EnvDefaultFunc("AWS_SECRET_ACCESS_KEY", nil),
+				Description: "The secret key used to authenticate with the S3-compatible endpoint. Only applies when driver = \"s3\".",
+			},
+
+			"force_path_style": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Whether to force path-style addressing (https://host/bucket/key) instead of virtual-hosted-style (https://bucket.host/key). Required by most non-AWS S3-compatible endpoints. Only applies when driver = \"s3\".",
+			},
+
+			"encryption_key": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Sensitive:   true,
+				DefaultFunc: schema.EnvDefaultFunc("UCLOUD_UFILE_ENCRYPTION_KEY", nil),
+				Description: "A base64-encoded 32-byte AES key used to client-side encrypt the state before it is uploaded. Mutually exclusive with kms_key_id.",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					raw, err := base64.StdEncoding.DecodeString(v.(string))
+					if err != nil {
+						return nil, []error{fmt.Errorf("%q must be valid base64: %s", k, err)}
+					}
+					if len(raw) != aesKeySize {
+						return nil, []error{fmt.Errorf("%q must decode to %d bytes, got %d", k, aesKeySize, len(raw))}
+					}
+					return nil, nil
+				},
+			},
+
+			"kms_key_id": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Description: "A KMS key alias or ID. When set, a random data encryption key is generated for every write, used to encrypt the state, and then itself encrypted via KMS and stored alongside the ciphertext so the master key can be rotated without rewriting state. Mutually exclusive with encryption_key. Also used as the SSE-KMS key ID when encrypt = true and sse_algorithm = \"KMS\".",
+			},
+
+			"encrypt": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Whether to request UFile server-side encryption of the state object, in addition to any client-side encryption configured via encryption_key or kms_key_id above.",
+			},
+
+			"sse_algorithm": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "AES256",
+				Description: "The server-side-encryption algorithm to request when encrypt = true: \"AES256\" or \"KMS\". With \"KMS\", kms_key_id, when set, is sent as the key ID; without it only the algorithm is sent.",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					algo := v.(string)
+					if algo != "AES256" && algo != "KMS" {
+						return nil, []error{fmt.Errorf("%q must be one of \"AES256\" or \"KMS\", got %q", k, algo)}
+					}
+					return nil, nil
+				},
+			},
+
+			"upload_part_size": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     defaultUploadPartSize,
+				Description: "The size, in bytes, of each part of a multipart state upload. Only takes effect for states larger than this size.",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if v.(int) < minUploadPartSize {
+						return nil, []error{fmt.Errorf("%q must be at least %d bytes", k, minUploadPartSize)}
+					}
+					return nil, nil
+				},
+			},
+
+			"upload_concurrency": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     defaultUploadConcurrency,
+				Description: "The number of part upload workers of a multipart state upload to run concurrently. The part uploads themselves are serialized, so parts are sent to UFile one at a time.",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if v.(int) < 1 {
+						return nil, []error{fmt.Errorf("%q must be at least 1", k)}
+					}
+					return nil, nil
+				},
+			},
+
+			"lock_timeout": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     0,
+				Description: "Seconds after which a held lock is considered stale and may be reclaimed by another client. 0 (the default) disables reclaiming and locks must be removed with force-unlock. Only applies when lock_backend = \"ufile\". Reclaiming is a plain overwrite, not a compare-and-swap: if two clients race to reclaim the same stale lock at the same instant, both can succeed, and the second write wins silently. lock_backend = \"umem\" does not have this gap, since its lease expires server-side instead of being reclaimed by a client.",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if v.(int) < 0 {
+						return nil, []error{fmt.Errorf("%q must not be negative", k)}
+					}
+					return nil, nil
+				},
+			},
+
+			"lock_backend": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Default:     "ufile",
+				Description: "Where to store the state lock: \"ufile\" (the default), a conditionally-written object alongside the state, or \"umem\", a UCloud UMem/Redis instance. umem avoids UFile's eventual consistency around the lock object and reclaims abandoned locks via lock_ttl instead of requiring force-unlock. With driver = \"s3\", \"ufile\" locking is not atomic -- see the driver description.",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					backend := v.(string)
+					if backend != "ufile" && backend != "umem" {
+						return nil, []error{fmt.Errorf("%q must be one of \"ufile\" or \"umem\", got %q", k, backend)}
+					}
+					return nil, nil
+				},
+			},
+
+			"umem_endpoint": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.EnvDefaultFunc("UCLOUD_UMEM_ENDPOINT", nil),
+				Description: "The host:port of the UMem/Redis instance to use for locking. Required when lock_backend = \"umem\".",
+			},
+
+			"umem_password": {
+				Type:        schema.TypeString,
+				Optional:    true,
+				Sensitive:   true,
+				DefaultFunc: schema.EnvDefaultFunc("UCLOUD_UMEM_PASSWORD", nil),
+				Description: "The password for the UMem/Redis instance. Only applies when lock_backend = \"umem\".",
+			},
+
+			"lock_ttl": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     defaultLockTTLSeconds,
+				Description: "Seconds a umem lock may be held before its lease expires. remoteClient renews the lease with a heartbeat roughly every third of this interval for as long as the lock is held, so this mostly bounds how long a lock outlives a crashed client. Only applies when lock_backend = \"umem\".",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if v.(int) < 1 {
+						return nil, []error{fmt.Errorf("%q must be at least 1", k)}
+					}
+					return nil, nil
+				},
+			},
+
+			"versioning": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Whether to use UFile object versioning to keep state history. The bucket must already have versioning enabled; configure will fail otherwise.",
+			},
+
+			"retention_days": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     0,
+				Description: "When set with versioning = true, installs a lifecycle rule that expires non-current state versions after this many days, so state history doesn't grow without bound.",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if v.(int) < 0 {
+						return nil, []error{fmt.Errorf("%q must not be negative", k)}
+					}
+					return nil, nil
+				},
+			},
+
+			"enable_versioning": {
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Whether to keep a copy of every state written under <prefix>/<workspace>/history, independent of UFile's own object versioning (see versioning above). This is what Backend.ListStateVersions, GetStateVersion and RollbackState operate on, and works with any driver.",
+			},
+
+			"max_versions": {
+				Type:        schema.TypeInt,
+				Optional:    true,
+				Default:     0,
+				Description: "When set with enable_versioning = true, prunes the oldest history objects beyond this count after every write. 0 (the default) keeps history forever.",
+				ValidateFunc: func(v interface{}, k string) ([]string, []error) {
+					if v.(int) < 0 {
+						return nil, []error{fmt.Errorf("%q must not be negative", k)}
+					}
+					return nil, nil
+				},
+			},
 		},
 	}
 
@@ -109,11 +334,59 @@ type Backend struct {
 
 	// The fields below are set from configure
 	ufileClient *ufsdk.UFileRequest
-	tagClient   *ubusinessgroup.UBusinessGroupClient
+	kmsClient   *kms.KMSClient
+
+	// ufileBucketClient is the UCloud API client used for bucket-level
+	// operations (DescribeBucket, SetBucketLifecycle, ...), as opposed to
+	// ufileClient above, which is the object-level ufile-gosdk request used
+	// for Get/Put/Delete of the state itself. Only set when driver = "ufile".
+	ufileBucketClient *ufile.UFileClient
 
 	bucketName string
 	keyName    string
 	prefix     string
+
+	// driver selects the ObjectStore implementation built in configure: the
+	// default "ufile", or "s3" for any S3-compatible endpoint.
+	driver         string
+	endpoint       string
+	accessKey      string
+	secretKey      string
+	forcePathStyle bool
+
+	// store is what remoteClient actually reads and writes through. See
+	// objectstore.go.
+	store ObjectStore
+
+	encryptionKey []byte
+	kmsKeyID      string
+
+	sseEnabled   bool
+	sseAlgorithm string
+
+	uploadPartSize    int64
+	uploadConcurrency int
+
+	lockTimeout time.Duration
+
+	// lockBackend selects where lock records are stored: the default
+	// "ufile", or "umem" for a UCloud UMem/Redis instance. See lock.go.
+	lockBackend  string
+	umemEndpoint string
+	umemPassword string
+	lockTTL      time.Duration
+	umemStore    umemStore
+
+	versioningEnabled bool
+	retentionDays     int
+
+	// historyEnabled and maxVersions configure the separate, driver-agnostic
+	// history mechanism in history.go, which copies every write to
+	// <prefix>/<workspace>/history instead of relying on bucket-level
+	// versioning. See versioningEnabled above for the UFile-native
+	// alternative.
+	historyEnabled bool
+	maxVersions    int
 }
 
 func (b *Backend) configure(ctx context.Context) error {
@@ -123,9 +396,79 @@ func (b *Backend) configure(ctx context.Context) error {
 	b.keyName = d.Get("key").(string)
 	b.prefix = d.Get("prefix").(string)
 
+	encryptionKey, hasEncryptionKey := d.GetOk("encryption_key")
+	kmsKeyID, hasKMSKeyID := d.GetOk("kms_key_id")
+	if hasEncryptionKey && hasKMSKeyID {
+		return errors.New("encryption_key and kms_key_id are mutually exclusive")
+	}
+	if hasEncryptionKey {
+		// already validated as base64(32 bytes) by the schema ValidateFunc
+		b.encryptionKey, _ = base64.StdEncoding.DecodeString(encryptionKey.(string))
+	}
+	if hasKMSKeyID {
+		b.kmsKeyID = kmsKeyID.(string)
+	}
+
+	b.sseEnabled = d.Get("encrypt").(bool)
+	b.sseAlgorithm = d.Get("sse_algorithm").(string)
+	if b.sseEnabled && hasKMSKeyID && b.sseAlgorithm != "KMS" {
+		return errors.New(`kms_key_id requires sse_algorithm = "KMS" when encrypt = true`)
+	}
+
+	b.uploadPartSize = int64(d.Get("upload_part_size").(int))
+	b.uploadConcurrency = d.Get("upload_concurrency").(int)
+	b.lockTimeout = time.Duration(d.Get("lock_timeout").(int)) * time.Second
+	b.versioningEnabled = d.Get("versioning").(bool)
+	b.retentionDays = d.Get("retention_days").(int)
+	b.historyEnabled = d.Get("enable_versioning").(bool)
+	b.maxVersions = d.Get("max_versions").(int)
+
+	b.lockBackend = d.Get("lock_backend").(string)
+	b.lockTTL = time.Duration(d.Get("lock_ttl").(int)) * time.Second
+	if b.lockBackend == "umem" {
+		b.umemEndpoint = d.Get("umem_endpoint").(string)
+		if b.umemEndpoint == "" {
+			return errors.New(`umem_endpoint is required when lock_backend = "umem"`)
+		}
+		b.umemPassword = d.Get("umem_password").(string)
+		b.umemStore = newRedisUmemStore(b.umemEndpoint, b.umemPassword)
+	}
+
+	b.driver = d.Get("driver").(string)
+	b.endpoint = d.Get("endpoint").(string)
+	b.accessKey = d.Get("access_key").(string)
+	b.secretKey = d.Get("secret_key").(string)
+	b.forcePathStyle = d.Get("force_path_style").(bool)
+
+	if b.driver == "s3" {
+		if b.versioningEnabled {
+			return errors.New("versioning is only supported with driver = \"ufile\"")
+		}
+		if b.kmsKeyID != "" {
+			return errors.New("kms_key_id is only supported with driver = \"ufile\"; it wraps data keys via UCloud KMS, which has no meaning against an S3-compatible endpoint")
+		}
+
+		store, err := newS3ObjectStore(b.endpoint, b.accessKey, b.secretKey, d.Get("region").(string), b.bucketName, b.forcePathStyle)
+		if err != nil {
+			return fmt.Errorf("Failed to build s3 client, %s", err)
+		}
+		b.store = store
+
+		return nil
+	}
+
+	region := d.Get("region").(string)
+	projectID := d.Get("project_id").(string)
+	if region == "" {
+		return errors.New(`region is required unless driver = "s3"`)
+	}
+	if projectID == "" {
+		return errors.New(`project_id is required unless driver = "s3"`)
+	}
+
 	cfg := ucloud.NewConfig()
-	cfg.Region = d.Get("region").(string)
-	cfg.ProjectId = d.Get("project_id").(string)
+	cfg.Region = region
+	cfg.ProjectId = projectID
 	cfg.UserAgent = fmt.Sprintf("Backend-UCloud/%s", version.Version)
 
 	// set default max retry count
@@ -139,7 +482,10 @@ func (b *Backend) configure(ctx context.Context) error {
 	cred.PrivateKey = d.Get("private_key").(string)
 
 	ufileClient := ufile.NewClient(&cfg, &cred)
-	b.tagClient = ubusinessgroup.NewClient(&cfg, &cred)
+	b.ufileBucketClient = ufileClient
+	if b.kmsKeyID != "" {
+		b.kmsClient = kms.NewClient(&cfg, &cred)
+	}
 
 	// set the ufile config
 	var bucketHost string
@@ -156,6 +502,17 @@ func (b *Backend) configure(ctx context.Context) error {
 		return fmt.Errorf("Failed to query bucket, %s", err)
 	}
 
+	if b.versioningEnabled {
+		if err := verifyBucketVersioning(ufileClient, b.bucketName); err != nil {
+			return err
+		}
+		if b.retentionDays > 0 {
+			if err := installVersionRetentionLifecycle(ufileClient, b.bucketName, b.prefix, b.retentionDays); err != nil {
+				return err
+			}
+		}
+	}
+
 	fileHost := strings.SplitN(domain, ".", 2)[1]
 	config := &ufsdk.Config{
 		PublicKey:  d.Get("public_key").(string),
@@ -171,6 +528,11 @@ func (b *Backend) configure(ctx context.Context) error {
 	}
 
 	b.ufileClient = reqFile
+	b.store = &ufileObjectStore{
+		client:            reqFile,
+		uploadPartSize:    b.uploadPartSize,
+		uploadConcurrency: b.uploadConcurrency,
+	}
 
 	return nil
 }
@@ -189,3 +551,43 @@ func queryBucket(conn *ufile.UFileClient, bucketName string) (string, error) {
 
 	return resp.DataSet[0].Domain.Src[0], nil
 }
+
+// verifyBucketVersioning checks that the bucket already has UFile object
+// versioning enabled, which is required for the versioning = true backend
+// option to be meaningful: this backend never enables it on the user's
+// behalf, since doing so changes the bucket's behavior for every object,
+// not just Terraform's.
+func verifyBucketVersioning(conn *ufile.UFileClient, bucketName string) error {
+	req := conn.NewDescribeBucketRequest()
+	req.BucketName = ucloud.String(bucketName)
+	resp, err := conn.DescribeBucket(req)
+	if err != nil {
+		return fmt.Errorf("error on reading bucket %q versioning status, %s", bucketName, err)
+	}
+
+	if len(resp.DataSet) < 1 {
+		return fmt.Errorf("the bucket %s is not exit", bucketName)
+	}
+
+	if resp.DataSet[0].Versioning != "Enabled" {
+		return fmt.Errorf("versioning = true requires bucket %q to have object versioning enabled; enable it in the UCloud console first", bucketName)
+	}
+
+	return nil
+}
+
+// installVersionRetentionLifecycle installs a lifecycle rule that expires
+// non-current versions of objects under prefix after retentionDays, so
+// state history doesn't grow without bound.
+func installVersionRetentionLifecycle(conn *ufile.UFileClient, bucketName, prefix string, retentionDays int) error {
+	req := conn.NewSetBucketLifecycleRequest()
+	req.BucketName = ucloud.String(bucketName)
+	req.Prefix = ucloud.String(prefix)
+	req.NoncurrentVersionExpirationDays = ucloud.Int(retentionDays)
+
+	if _, err := conn.SetBucketLifecycle(req); err != nil {
+		return fmt.Errorf("error on installing state history retention lifecycle rule on bucket %q, %s", bucketName, err)
+	}
+
+	return nil
+}
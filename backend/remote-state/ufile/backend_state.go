@@ -14,6 +14,11 @@ import (
 
 const (
 	lockFileSuffix = ".tflock"
+
+	// stateHistoryDir is the subdirectory under <prefix>/<workspace> that
+	// holds timestamped copies of every write when enable_versioning is
+	// set. See history.go.
+	stateHistoryDir = "history"
 )
 
 // get a remote client configured for this state
@@ -23,11 +28,23 @@ func (b *Backend) remoteClient(name string) (*remoteClient, error) {
 	}
 
 	client := &remoteClient{
-		ufileClient: b.ufileClient,
-		tagClient:   b.tagClient,
-		bucketName:  b.bucketName,
-		stateFile:   b.stateFile(name),
-		lockFile:    b.lockFile(name),
+		store:          b.store,
+		ufileClient:    b.ufileClient,
+		kmsClient:      b.kmsClient,
+		bucketName:     b.bucketName,
+		stateFile:      b.stateFile(name),
+		lockFile:       b.lockFile(name),
+		encryptionKey:  b.encryptionKey,
+		kmsKeyID:       b.kmsKeyID,
+		sseEnabled:     b.sseEnabled,
+		sseAlgorithm:   b.sseAlgorithm,
+		lockTimeout:    b.lockTimeout,
+		lockBackend:    b.lockBackend,
+		umemStore:      b.umemStore,
+		lockTTL:        b.lockTTL,
+		historyEnabled: b.historyEnabled,
+		historyPrefix:  path.Join(b.prefix, name, stateHistoryDir),
+		maxVersions:    b.maxVersions,
 	}
 
 	return client, nil
@@ -38,31 +55,36 @@ func (b *Backend) Workspaces() ([]string, error) {
 	var limit = 20
 	var marker string
 	for {
-		resp, err := b.ufileClient.PrefixFileList(b.prefix, marker, limit)
+		keys, nextMarker, err := b.store.PrefixFileList(b.prefix, marker, limit)
 		if err != nil {
 			return nil, fmt.Errorf("error on reading file list by prefix, %s", err)
 		}
 
-		if len(resp.DataSet) < 1 {
+		if len(keys) < 1 {
 			break
 		}
 
-		for _, v := range resp.DataSet {
-			if path.Join(b.prefix, b.keyName) == v.FileName {
+		for _, key := range keys {
+			if path.Join(b.prefix, b.keyName) == key {
 				// filter the default workspace
 				continue
 			}
-			parts := strings.Split(strings.TrimPrefix(v.FileName, b.prefix+"/"), "/")
+			parts := strings.Split(strings.TrimPrefix(key, b.prefix+"/"), "/")
+			if len(parts) > 1 && parts[1] == stateHistoryDir {
+				// history objects live under <prefix>/<workspace>/history
+				// (see history.go) and aren't themselves workspaces.
+				continue
+			}
 			if len(parts) > 0 && parts[0] != "" {
 				wss = append(wss, parts[0])
 			}
 		}
 
-		if len(resp.DataSet) < limit {
+		if len(keys) < limit {
 			break
 		}
 
-		marker = resp.NextMarker
+		marker = nextMarker
 	}
 
 	sort.Strings(wss[1:])
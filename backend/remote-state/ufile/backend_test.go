@@ -48,14 +48,6 @@ func TestBackendConfig(t *testing.T) {
 	if b.keyName != "state" {
 		t.Fatalf("Incorrect keyName was populated")
 	}
-
-	credentials := b.tagClient.Client.GetCredential()
-	if credentials.PrivateKey == "" {
-		t.Fatalf("No Private Key was populated")
-	}
-	if credentials.PrivateKey == "" {
-		t.Fatalf("No Private Key was populated")
-	}
 }
 
 func TestBackendConfig_invalidKey(t *testing.T) {
@@ -133,8 +125,8 @@ func TestBackendExtraPaths(t *testing.T) {
 
 	// remoteClient to Put things in various paths
 	client := &remoteClient{
+		store:       b.store,
 		ufileClient: b.ufileClient,
-		tagClient:   b.tagClient,
 		bucketName:  b.bucketName,
 		stateFile:   b.stateFile("s1"),
 		lockFile:    b.lockFile("s1"),
@@ -223,6 +215,24 @@ func TestBackendExtraPaths(t *testing.T) {
 	if err := checkStateList(b, []string{"default", "s1", "s2"}); err != nil {
 		t.Fatal(err)
 	}
+
+	// history objects (written under <workspace>/history when
+	// enable_versioning is set, see history.go) must not be mistaken for
+	// workspaces, including under the "default" workspace.
+	//
+	// This relies on the remoteClient literal above having store set --
+	// otherwise
+	// stateMgr.PersistState() panics on a nil store long before execution
+	// ever reaches these assertions.
+	if err := b.store.PutObject(b.prefix+"/s1/history/123-abc.tfstate", []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.store.PutObject(b.prefix+"/default/history/123-abc.tfstate", []byte("{}"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := checkStateList(b, []string{"default", "s1", "s2"}); err != nil {
+		t.Fatal(err)
+	}
 }
 
 // ensure we can separate the workspace prefix when it also matches the prefix
@@ -1,300 +1,209 @@
 package ufile
 
 import (
-	"bufio"
-	"bytes"
 	"crypto/md5"
-	"encoding/json"
+	"encoding/base64"
+	"errors"
 	"fmt"
-	"github.com/hashicorp/go-multierror"
-	"github.com/hashicorp/go-uuid"
-	"github.com/hashicorp/terraform/state"
+	"net/http"
+	"sync"
+	"time"
+
 	"github.com/hashicorp/terraform/state/remote"
-	"github.com/ucloud/ucloud-sdk-go/private/services/ubusinessgroup"
+	"github.com/ucloud/ucloud-sdk-go/services/kms"
 	"github.com/ucloud/ucloud-sdk-go/ucloud"
 	ufsdk "github.com/ufilesdk-dev/ufile-gosdk"
 )
 
 type remoteClient struct {
+	store ObjectStore
+
+	// ufileClient is retained alongside store for UFile-specific features
+	// that don't fit the generic ObjectStore interface, namely object
+	// versioning (versioning.go). It is nil when driver = "s3".
 	ufileClient *ufsdk.UFileRequest
-	tagClient   *ubusinessgroup.UBusinessGroupClient
+	kmsClient   *kms.KMSClient
 	bucketName  string
 	stateFile   string
 	lockFile    string
-}
 
-const lockPrefix = "terraform-lock"
+	// encryptionKey and kmsKeyID are mutually exclusive; when either is set
+	// Put/Get transparently encrypt/decrypt state at rest. See
+	// crypto.go for the on-disk header format.
+	encryptionKey []byte
+	kmsKeyID      string
 
-func (c *remoteClient) Get() (payload *remote.Payload, err error) {
-	payload, exist, err := c.getObject(c.stateFile)
-	if err != nil {
-		return nil, fmt.Errorf("Failed to geting state file at %v: %s", c.stateFileURL(), err)
-	}
+	// sseEnabled and sseAlgorithm request UFile server-side encryption of
+	// the uploaded object, independent of (and in addition to) the
+	// client-side encryption above. See sseHeaders.
+	sseEnabled   bool
+	sseAlgorithm string
 
-	if !exist {
-		return nil, nil
-	}
+	// lockTimeout bounds how long a lock may be held before another client
+	// is allowed to reclaim it. Only used when lockBackend == "ufile". See
+	// lock.go.
+	lockTimeout time.Duration
 
-	return payload, nil
-}
+	// lockBackend selects where Lock/Unlock store lock records: the
+	// default "ufile", or "umem" for a UCloud UMem/Redis instance. umemStore
+	// and lockTTL only matter for the latter. See lock.go.
+	lockBackend string
+	umemStore   umemStore
+	lockTTL     time.Duration
 
-func (c *remoteClient) Put(data []byte) error {
-	if err := c.putObject(c.stateFile, data); err != nil {
-		return fmt.Errorf("Failed to upload state file to %v: %s", c.stateFileURL(), err)
-	}
-
-	return nil
-}
+	umemHeartbeatMu   sync.Mutex
+	umemHeartbeatStop chan struct{}
 
-func (c *remoteClient) Delete() error {
-	if err := c.deleteObject(c.stateFile); err != nil {
-		return fmt.Errorf("Failed to delete state file to %v: %s", c.stateFileURL(), err)
-	}
-	return nil
+	// historyEnabled, historyPrefix and maxVersions configure the history
+	// copies Put writes on every call. See history.go.
+	historyEnabled bool
+	historyPrefix  string
+	maxVersions    int
 }
 
-func (c *remoteClient) delete() error {
-	if err := c.deleteObject(c.stateFile); err != nil {
-		return fmt.Errorf("Failed to delete state file to %v: %s", c.stateFileURL(), err)
-	}
-	return nil
-}
-
-func (c *remoteClient) Lock(info *state.LockInfo) (string, error) {
-	key := fmt.Sprintf("%s:%s:%s", lockPrefix, c.bucketName, c.lockFile)
-
-	tagId, err := c.ufileLock(key)
+func (c *remoteClient) Get() (payload *remote.Payload, err error) {
+	payload, exist, err := c.getObject(c.stateFile)
 	if err != nil {
-		return "", c.lockError(err)
+		return nil, fmt.Errorf("Failed to geting state file at %v: %s", c.stateFileURL(), err)
 	}
 
-	_, exist, err := c.getObject(c.lockFile)
-	if err != nil {
-		err = fmt.Errorf("Failed to geting lock file at %v: %s", c.lockFileURL(), err)
-	}
-	if exist {
-		err = fmt.Errorf("Lock file exist at %v", c.lockFileURL())
-	}
-	if err != nil {
-		return "", c.lockError(c.ufileUnlock(tagId, err))
+	if !exist {
+		return nil, nil
 	}
 
-	info.Path = c.lockFileURL()
-
-	if info.ID == "" {
-		lockID, err := uuid.GenerateUUID()
+	if isEncryptedPayload(payload.Data) {
+		plaintext, err := c.decrypt(payload.Data)
 		if err != nil {
-			return "", c.lockError(c.ufileUnlock(tagId, err))
+			return nil, fmt.Errorf("Failed to decrypt state file at %v: %s", c.stateFileURL(), err)
 		}
-
-		info.ID = lockID
+		sum := md5.Sum(plaintext)
+		payload = &remote.Payload{Data: plaintext, MD5: sum[:]}
 	}
 
-	if c.putObject(c.lockFile, info.Marshal()) != nil {
-		err = fmt.Errorf("Failed to put lock file at %v: %s", c.lockFileURL(), err)
-		return "", c.lockError(c.ufileUnlock(tagId, err))
-	}
+	return payload, nil
+}
 
-	if err = c.ufileUnlock(tagId, nil); err != nil {
-		return "", c.lockError(err)
+// encrypt encrypts data according to the configured encryption_key or
+// kms_key_id, returning data unmodified if neither is set.
+func (c *remoteClient) encrypt(data []byte) ([]byte, error) {
+	switch {
+	case c.kmsKeyID != "":
+		return encryptStateDataEnvelope(data, c.kmsWrapDataKey)
+	case len(c.encryptionKey) > 0:
+		return encryptStateData(c.encryptionKey, data)
+	default:
+		return data, nil
 	}
-
-	return info.ID, nil
 }
 
-func (c *remoteClient) Unlock(id string) error {
-	info, err := c.lockInfo()
-	if err != nil {
-		return c.lockError(err)
+// decrypt reverses encrypt. Callers must only invoke it on data for which
+// isEncryptedPayload reports true.
+func (c *remoteClient) decrypt(data []byte) ([]byte, error) {
+	mode := data[len(cryptoMagic)+1]
+	if mode == cryptoModeKMSEnvelope {
+		return decryptStateDataEnvelope(data, c.kmsUnwrapDataKey)
 	}
 
-	if info.ID != id {
-		return c.lockError(fmt.Errorf("lock ID %q does not match existing lock %q", id, info.ID))
+	if len(c.encryptionKey) == 0 {
+		return nil, errors.New("state is encrypted but no encryption_key is configured")
 	}
+	return decryptStateData(c.encryptionKey, data)
+}
 
-	err = c.deleteObject(c.lockFile)
-	if err != nil {
-		return c.lockError(err)
-	}
+// kmsWrapDataKey encrypts a per-write data encryption key via KMS so it can
+// be stored alongside the ciphertext it protects.
+func (c *remoteClient) kmsWrapDataKey(dataKey []byte) ([]byte, error) {
+	req := c.kmsClient.NewEncryptRequest()
+	req.KeyId = ucloud.String(c.kmsKeyID)
+	req.Plaintext = ucloud.String(base64.StdEncoding.EncodeToString(dataKey))
 
-	key := fmt.Sprintf("%s:%s:%s", lockPrefix, c.bucketName, c.lockFile)
-	tagId, err := c.DescribeTag(key)
+	resp, err := c.kmsClient.Encrypt(req)
 	if err != nil {
-		if isNotExistError(err) {
-			return nil
-		}
-		return c.lockError(err)
+		return nil, err
 	}
 
-	return c.DeleteTag(tagId)
+	return base64.StdEncoding.DecodeString(resp.CiphertextBlob)
 }
 
-func (c *remoteClient) lockError(err error) *state.LockError {
-	lockErr := &state.LockError{
-		Err: err,
-	}
-
-	info, infoErr := c.lockInfo()
-	if infoErr != nil {
-		lockErr.Err = multierror.Append(lockErr.Err, infoErr)
-	} else {
-		lockErr.Info = info
-	}
-	return lockErr
-}
+// kmsUnwrapDataKey decrypts a data encryption key previously wrapped by
+// kmsWrapDataKey.
+func (c *remoteClient) kmsUnwrapDataKey(wrappedKey []byte) ([]byte, error) {
+	req := c.kmsClient.NewDecryptRequest()
+	req.KeyId = ucloud.String(c.kmsKeyID)
+	req.CiphertextBlob = ucloud.String(base64.StdEncoding.EncodeToString(wrappedKey))
 
-func (c *remoteClient) lockInfo() (*state.LockInfo, error) {
-	payload, exist, err := c.getObject(c.lockFile)
+	resp, err := c.kmsClient.Decrypt(req)
 	if err != nil {
 		return nil, err
 	}
 
-	if !exist {
-		return nil, newNotExistError(fmt.Sprintf("lock file %s", c.lockFile))
-	}
-
-	info := &state.LockInfo{}
-	if err := json.Unmarshal(payload.Data, info); err != nil {
-		return nil, err
-	}
-
-	return info, nil
+	return base64.StdEncoding.DecodeString(resp.Plaintext)
 }
 
-func (c *remoteClient) putObject(file string, data []byte) error {
-	state, err := c.ufileClient.InitiateMultipartUpload(file, "application/json")
+func (c *remoteClient) Put(data []byte) error {
+	data, err := c.encrypt(data)
 	if err != nil {
-		return fmt.Errorf("error on initing upload file, %s", err)
+		return fmt.Errorf("Failed to encrypt state file for %v: %s", c.stateFileURL(), err)
 	}
 
-	if err := c.ufileClient.UploadPart(bytes.NewBuffer(data), state, 0); err != nil {
-		// ignore err
-		_ = c.ufileClient.AbortMultipartUpload(state)
-		return fmt.Errorf("error on uploading file, %s", err)
-	}
-
-	if err := c.ufileClient.FinishMultipartUpload(state); err != nil {
-		return fmt.Errorf("error on finishing upload file, %s", err)
+	if err := c.putObject(c.stateFile, data, c.sseHeaders()); err != nil {
+		return fmt.Errorf("Failed to upload state file to %v: %s", c.stateFileURL(), err)
 	}
 
-	return nil
-}
-
-func (c *remoteClient) getObject(file string) (payload *remote.Payload, exist bool, err error) {
-	var buf []byte
-	buffer := bufio.NewWriter(bytes.NewBuffer(buf))
-	err = c.ufileClient.DownloadFile(buffer, file)
-	if err != nil {
-		if c.ufileClient.LastResponseStatus == 404 {
-			return nil, false, nil
+	if c.historyEnabled {
+		if err := c.writeHistory(data); err != nil {
+			return fmt.Errorf("Failed to write state history for %v: %s", c.stateFileURL(), err)
 		}
-		return
-	}
-	exist = true
-	sum := md5.Sum(c.ufileClient.LastResponseBody)
-	payload = &remote.Payload{
-		Data: c.ufileClient.LastResponseBody,
-		MD5:  sum[:],
 	}
 
-	return
-}
-
-func (c *remoteClient) deleteObject(file string) error {
-	if err := c.ufileClient.DeleteFile(file); err != nil {
-		return fmt.Errorf("error on deleting file, %s", err)
-	}
 	return nil
 }
 
-func (c *remoteClient) ufileLock(key string) (string, error) {
-	if err := c.CreateTag(key); err != nil {
-		return "", err
+// sseHeaders returns the UFile server-side-encryption headers to attach to
+// a PutObject call, or nil when encrypt = false.
+func (c *remoteClient) sseHeaders() http.Header {
+	if !c.sseEnabled {
+		return nil
 	}
 
-	tagId, err := c.DescribeTag(key)
-	if err != nil {
-		return "", err
+	h := http.Header{}
+	h.Set("X-UFile-Server-Side-Encryption", c.sseAlgorithm)
+	if c.sseAlgorithm == "KMS" && c.kmsKeyID != "" {
+		h.Set("X-UFile-Server-Side-Encryption-Kms-Key-Id", c.kmsKeyID)
 	}
-
-	return tagId, nil
+	return h
 }
 
-func (c *remoteClient) ufileUnlock(tagId string, err error) error {
-	errTag := c.DeleteTag(tagId)
-	if err != nil {
-		if errTag != nil {
-			return c.lockError(fmt.Errorf("%v, delete tag err: %s", err, errTag))
-		}
-		return c.lockError(err)
-	}
-
-	if errTag != nil {
-		return errTag
+func (c *remoteClient) Delete() error {
+	if err := c.deleteObject(c.stateFile); err != nil {
+		return fmt.Errorf("Failed to delete state file to %v: %s", c.stateFileURL(), err)
 	}
-
 	return nil
 }
 
-func (c *remoteClient) CreateTag(key string) error {
-	request := c.tagClient.NewCreateBusinessGroupRequest()
-	request.BusinessName = ucloud.String(key)
-
-	_, err := c.tagClient.CreateBusinessGroup(request)
-	if err != nil {
-		return fmt.Errorf("err on creating tag, %s", err)
+func (c *remoteClient) delete() error {
+	if err := c.deleteObject(c.stateFile); err != nil {
+		return fmt.Errorf("Failed to delete state file to %v: %s", c.stateFileURL(), err)
 	}
-
 	return nil
 }
 
-func (c *remoteClient) DescribeTag(key string) (string, error) {
-	req := c.tagClient.NewListBusinessGroupRequest()
-
-	var allInstances []ubusinessgroup.BusinessGroupInfo
-	var limit = 100
-	var offset int
-	for {
-		req.Limit = ucloud.Int(limit)
-		req.Offset = ucloud.Int(offset)
-		resp, err := c.tagClient.ListBusinessGroup(req)
-		if err != nil {
-			return "", fmt.Errorf("error on reading tag list, %s", err)
-		}
-
-		if resp == nil || len(resp.Infos) < 1 {
-			break
-		}
-
-		allInstances = append(allInstances, resp.Infos...)
-
-		if len(resp.Infos) < limit {
-			break
-		}
-
-		offset = offset + limit
-	}
+func (c *remoteClient) putObject(file string, data []byte, headers http.Header) error {
+	return c.store.PutObject(file, data, headers)
+}
 
-	for _, v := range allInstances {
-		if v.BusinessName == key {
-			return v.BusinessId, nil
-		}
+func (c *remoteClient) getObject(file string) (payload *remote.Payload, exist bool, err error) {
+	data, exist, err := c.store.GetObject(file)
+	if err != nil || !exist {
+		return nil, exist, err
 	}
 
-	return "", newNotExistError("tag")
+	sum := md5.Sum(data)
+	return &remote.Payload{Data: data, MD5: sum[:]}, true, nil
 }
 
-func (c *remoteClient) DeleteTag(tagId string) error {
-	request := c.tagClient.NewDeleteBusinessGroupRequest()
-	request.BusinessId = ucloud.String(tagId)
-
-	_, err := c.tagClient.DeleteBusinessGroup(request)
-
-	if err != nil {
-		return fmt.Errorf("err on deleting tag, %s", err)
-	}
-
-	return nil
+func (c *remoteClient) deleteObject(file string) error {
+	return c.store.DeleteObject(file)
 }
 
 func (c *remoteClient) stateFileURL() string {
@@ -2,6 +2,10 @@ package ufile
 
 import (
 	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -15,6 +19,85 @@ func TestRemoteClient_impl(t *testing.T) {
 	var _ remote.ClientLocker = new(remoteClient)
 }
 
+// fakeObjectStore is an in-memory ObjectStore, which lets most of
+// remoteClient's behavior (encryption, locking, workspace prefixing) be unit
+// tested without a live bucket or testACC.
+type fakeObjectStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+}
+
+func newFakeObjectStore() *fakeObjectStore {
+	return &fakeObjectStore{objects: make(map[string][]byte)}
+}
+
+func (s *fakeObjectStore) PutObject(key string, data []byte, headers http.Header) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.objects[key] = data
+	return nil
+}
+
+func (s *fakeObjectStore) PutObjectIfAbsent(key string, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exist := s.objects[key]; exist {
+		return errAlreadyLocked
+	}
+	s.objects[key] = data
+	return nil
+}
+
+func (s *fakeObjectStore) GetObject(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, exist := s.objects[key]
+	return data, exist, nil
+}
+
+func (s *fakeObjectStore) DeleteObject(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *fakeObjectStore) PrefixFileList(prefix, marker string, limit int) ([]string, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys, "", nil
+}
+
+func TestRemoteClient_fake(t *testing.T) {
+	client := &remoteClient{
+		store:      newFakeObjectStore(),
+		bucketName: "test-bucket",
+		stateFile:  "test-state",
+		lockFile:   "test-state.tflock",
+	}
+
+	remote.TestClient(t, client)
+}
+
+func TestRemoteClient_fakeEncrypted(t *testing.T) {
+	client := &remoteClient{
+		store:         newFakeObjectStore(),
+		bucketName:    "test-bucket",
+		stateFile:     "test-state",
+		lockFile:      "test-state.tflock",
+		encryptionKey: make([]byte, aesKeySize),
+	}
+
+	remote.TestClient(t, client)
+}
+
 func TestRemoteClient(t *testing.T) {
 	testACC(t)
 	bucketName := fmt.Sprintf("terraform-remote-ufile-test-%x", time.Now().Unix())
@@ -0,0 +1,202 @@
+package ufile
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// State blobs that have been encrypted by this backend are prefixed with a
+// small header so that `Get` can tell an encrypted object from a plain
+// one (e.g. state written before encryption was enabled) and so the header
+// can grow in the future without breaking old objects.
+//
+//	magic(4) | version(1) | mode(1) | nonce(12) | [envelope] | ciphertext
+//
+// where envelope is only present when mode == cryptoModeKMSEnvelope:
+//
+//	envelopeLen(2) | encryptedDataKey(envelopeLen)
+const (
+	cryptoMagic        = "TFUE"
+	cryptoVersion byte = 1
+
+	// cryptoModeDirect encrypts the state directly with the configured
+	// encryption_key.
+	cryptoModeDirect byte = 0
+	// cryptoModeKMSEnvelope encrypts the state with a random, per-write data
+	// encryption key, which is itself encrypted ("wrapped") via KMS and
+	// stored alongside the ciphertext.
+	cryptoModeKMSEnvelope byte = 1
+
+	aesKeySize   = 32 // AES-256
+	gcmNonceSize = 12
+)
+
+var errNotEncrypted = errors.New("data does not have an encrypted state header")
+
+// isEncryptedPayload reports whether data begins with the header this
+// backend writes when encryption is enabled, so Get can tell an
+// encrypted object apart from a plaintext one written before encryption was
+// turned on.
+func isEncryptedPayload(data []byte) bool {
+	return len(data) >= len(cryptoMagic)+2 && string(data[:len(cryptoMagic)]) == cryptoMagic
+}
+
+// encryptStateData encrypts plaintext with key using AES-256-GCM and a fresh
+// random nonce, returning the header-prefixed ciphertext described above.
+func encryptStateData(key, plaintext []byte) ([]byte, error) {
+	if len(key) != aesKeySize {
+		return nil, fmt.Errorf("encryption key must be %d bytes, got %d", aesKeySize, len(key))
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcmNonceSize)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, fmt.Errorf("error generating nonce: %s", err)
+	}
+
+	header := make([]byte, 0, len(cryptoMagic)+2+len(nonce))
+	header = append(header, cryptoMagic...)
+	header = append(header, cryptoVersion, cryptoModeDirect)
+	header = append(header, nonce...)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// decryptStateData reverses encryptStateData, returning an error if the
+// header is missing, malformed, or the data was tampered with.
+func decryptStateData(key, data []byte) ([]byte, error) {
+	if !isEncryptedPayload(data) {
+		return nil, errNotEncrypted
+	}
+
+	rest := data[len(cryptoMagic):]
+	version, mode := rest[0], rest[1]
+	if version != cryptoVersion {
+		return nil, fmt.Errorf("unsupported state encryption header version %d", version)
+	}
+	if mode != cryptoModeDirect {
+		return nil, fmt.Errorf("state was encrypted in envelope mode and requires kms_key_id to decrypt")
+	}
+	rest = rest[2:]
+
+	if len(rest) < gcmNonceSize {
+		return nil, errors.New("encrypted state header is truncated")
+	}
+	nonce, ciphertext := rest[:gcmNonceSize], rest[gcmNonceSize:]
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt state, the encryption_key may be wrong or the state may be corrupt: %s", err)
+	}
+
+	return plaintext, nil
+}
+
+// encryptStateDataEnvelope encrypts plaintext with a freshly generated data
+// encryption key, wraps that key via wrapKey (normally a KMS Encrypt call),
+// and stores the wrapped key alongside the ciphertext so the master key can
+// be rotated without rewriting existing state objects.
+func encryptStateDataEnvelope(plaintext []byte, wrapKey func([]byte) ([]byte, error)) ([]byte, error) {
+	dataKey := make([]byte, aesKeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, fmt.Errorf("error generating data encryption key: %s", err)
+	}
+
+	encrypted, err := encryptStateData(dataKey, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	// encryptStateData wrote a direct-mode header; switch it to envelope
+	// mode and splice in the wrapped data key.
+	encrypted[len(cryptoMagic)+1] = cryptoModeKMSEnvelope
+
+	wrappedKey, err := wrapKey(dataKey)
+	if err != nil {
+		return nil, fmt.Errorf("error encrypting data key via kms: %s", err)
+	}
+	if len(wrappedKey) > 0xffff {
+		return nil, errors.New("kms-wrapped data key is too large to store")
+	}
+
+	headerLen := len(cryptoMagic) + 2 + gcmNonceSize
+	out := make([]byte, 0, headerLen+2+len(wrappedKey)+(len(encrypted)-headerLen))
+	out = append(out, encrypted[:headerLen]...)
+	envelopeLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(envelopeLen, uint16(len(wrappedKey)))
+	out = append(out, envelopeLen...)
+	out = append(out, wrappedKey...)
+	out = append(out, encrypted[headerLen:]...)
+
+	return out, nil
+}
+
+// decryptStateDataEnvelope reverses encryptStateDataEnvelope, unwrapping the
+// per-write data key via unwrapKey (normally a KMS Decrypt call) before
+// decrypting the state itself.
+func decryptStateDataEnvelope(data []byte, unwrapKey func([]byte) ([]byte, error)) ([]byte, error) {
+	if !isEncryptedPayload(data) {
+		return nil, errNotEncrypted
+	}
+
+	rest := data[len(cryptoMagic):]
+	version, mode := rest[0], rest[1]
+	if version != cryptoVersion {
+		return nil, fmt.Errorf("unsupported state encryption header version %d", version)
+	}
+	if mode != cryptoModeKMSEnvelope {
+		return nil, errors.New("state was not encrypted in kms envelope mode")
+	}
+	rest = rest[2:]
+
+	if len(rest) < gcmNonceSize+2 {
+		return nil, errors.New("encrypted state header is truncated")
+	}
+	nonce := rest[:gcmNonceSize]
+	rest = rest[gcmNonceSize:]
+
+	envelopeLen := binary.BigEndian.Uint16(rest[:2])
+	rest = rest[2:]
+	if len(rest) < int(envelopeLen) {
+		return nil, errors.New("encrypted state header is truncated")
+	}
+	wrappedKey, ciphertext := rest[:envelopeLen], rest[envelopeLen:]
+
+	dataKey, err := unwrapKey(wrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting data key via kms: %s", err)
+	}
+
+	gcm, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt state, the kms_key_id may be wrong or the state may be corrupt: %s", err)
+	}
+
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid encryption key: %s", err)
+	}
+	return cipher.NewGCM(block)
+}
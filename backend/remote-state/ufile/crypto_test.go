@@ -0,0 +1,117 @@
+package ufile
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptDecryptStateData(t *testing.T) {
+	key := bytes.Repeat([]byte("a"), aesKeySize)
+	plaintext := []byte(`{"version": 4}`)
+
+	ciphertext, err := encryptStateData(key, plaintext)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !isEncryptedPayload(ciphertext) {
+		t.Fatal("expected ciphertext to be recognized as an encrypted payload")
+	}
+
+	got, err := decryptStateData(key, ciphertext)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("decrypted data %q does not match plaintext %q", got, plaintext)
+	}
+}
+
+func TestDecryptStateData_wrongKey(t *testing.T) {
+	key := bytes.Repeat([]byte("a"), aesKeySize)
+	otherKey := bytes.Repeat([]byte("b"), aesKeySize)
+
+	ciphertext, err := encryptStateData(key, []byte("secret state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := decryptStateData(otherKey, ciphertext); err == nil {
+		t.Fatal("expected an error decrypting with the wrong key")
+	}
+}
+
+func TestDecryptStateData_tampered(t *testing.T) {
+	key := bytes.Repeat([]byte("a"), aesKeySize)
+
+	ciphertext, err := encryptStateData(key, []byte("secret state"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, ciphertext...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	if _, err := decryptStateData(key, tampered); err == nil {
+		t.Fatal("expected an error decrypting tampered ciphertext")
+	}
+}
+
+func TestEncryptDecryptStateDataEnvelope_rotation(t *testing.T) {
+	// A fake KMS master key, used only to wrap/unwrap the per-write data
+	// encryption key. This stands in for the real KMS client.
+	masterKey := bytes.Repeat([]byte("m"), aesKeySize)
+	wrap := func(dataKey []byte) ([]byte, error) {
+		return encryptStateData(masterKey, dataKey)
+	}
+	unwrap := func(wrapped []byte) ([]byte, error) {
+		return decryptStateData(masterKey, wrapped)
+	}
+
+	plaintext := []byte(`{"version": 4, "serial": 1}`)
+	ciphertext, err := encryptStateDataEnvelope(plaintext, wrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := decryptStateDataEnvelope(ciphertext, unwrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("decrypted data %q does not match plaintext %q", got, plaintext)
+	}
+
+	// Rotating the master key only requires swapping unwrap/wrap - the
+	// already-written object doesn't need to be rewritten since its data key
+	// was generated independently of the master key's identity.
+	rotatedMasterKey := bytes.Repeat([]byte("n"), aesKeySize)
+	rotatedWrap := func(dataKey []byte) ([]byte, error) {
+		return encryptStateData(rotatedMasterKey, dataKey)
+	}
+	rotatedUnwrap := func(wrapped []byte) ([]byte, error) {
+		return decryptStateData(rotatedMasterKey, wrapped)
+	}
+
+	newPlaintext := []byte(`{"version": 4, "serial": 2}`)
+	newCiphertext, err := encryptStateDataEnvelope(newPlaintext, rotatedWrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The old object still decrypts fine with the pre-rotation master key...
+	if _, err := decryptStateDataEnvelope(ciphertext, unwrap); err != nil {
+		t.Fatalf("old object should still decrypt with its original wrapped key: %s", err)
+	}
+	// ...but not with the rotated one, and the new object is the reverse.
+	if _, err := decryptStateDataEnvelope(ciphertext, rotatedUnwrap); err == nil {
+		t.Fatal("expected old object to fail to decrypt with the rotated master key")
+	}
+	got, err = decryptStateDataEnvelope(newCiphertext, rotatedUnwrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, newPlaintext) {
+		t.Fatalf("decrypted data %q does not match plaintext %q", got, newPlaintext)
+	}
+}
@@ -0,0 +1,15 @@
+package ufile
+
+// gate is a simple counting semaphore used to bound the number of
+// concurrent multipart upload workers.
+type gate struct {
+	c chan struct{}
+}
+
+func newGate(n int) *gate {
+	return &gate{c: make(chan struct{}, n)}
+}
+
+func (g *gate) enter() { g.c <- struct{}{} }
+
+func (g *gate) leave() { <-g.c }
@@ -0,0 +1,40 @@
+package ufile
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestGate_boundsConcurrency(t *testing.T) {
+	const limit = 3
+	const workers = 20
+
+	g := newGate(limit)
+	var current, max int32
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			g.enter()
+			defer g.leave()
+
+			n := atomic.AddInt32(&current, 1)
+			for {
+				m := atomic.LoadInt32(&max)
+				if n <= m || atomic.CompareAndSwapInt32(&max, m, n) {
+					break
+				}
+			}
+			atomic.AddInt32(&current, -1)
+		}()
+	}
+
+	wg.Wait()
+
+	if max > limit {
+		t.Fatalf("gate allowed %d concurrent workers, want at most %d", max, limit)
+	}
+}
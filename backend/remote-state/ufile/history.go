@@ -0,0 +1,205 @@
+package ufile
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/terraform/state"
+)
+
+// HistoryVersion identifies one historical copy of a state file written
+// while enable_versioning is set. ID is what ListStateVersions returns and
+// GetStateVersion/RollbackState accept.
+type HistoryVersion struct {
+	ID        string
+	Timestamp time.Time
+}
+
+// writeHistory copies data, which has already been through encrypt and is
+// about to be (or has just been) written as the current state, to a new
+// timestamped object under historyPrefix, then prunes old entries beyond
+// maxVersions. It's called from Put when historyEnabled is set.
+func (c *remoteClient) writeHistory(data []byte) error {
+	key := c.historyKey(data)
+	if err := c.putObject(key, data, c.sseHeaders()); err != nil {
+		return err
+	}
+	return c.pruneHistory()
+}
+
+// historyKey names a history object so that lexicographic order matches
+// chronological order (fixed-width nanosecond timestamps). The content hash
+// keeps two writes issued in the same nanosecond apart unless their content
+// is also identical.
+func (c *remoteClient) historyKey(data []byte) string {
+	sum := sha256.Sum256(data)
+	return fmt.Sprintf("%s/%019d-%x.tfstate", c.historyPrefix, time.Now().UnixNano(), sum)
+}
+
+// pruneHistory deletes the oldest history objects beyond maxVersions. A
+// maxVersions of 0 means keep everything.
+func (c *remoteClient) pruneHistory() error {
+	if c.maxVersions <= 0 {
+		return nil
+	}
+
+	versions, err := c.listHistory()
+	if err != nil {
+		return err
+	}
+	if len(versions) <= c.maxVersions {
+		return nil
+	}
+
+	for _, v := range versions[:len(versions)-c.maxVersions] {
+		if err := c.deleteObject(path.Join(c.historyPrefix, v.ID)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listHistory returns every history object under historyPrefix, oldest
+// first.
+func (c *remoteClient) listHistory() ([]HistoryVersion, error) {
+	var versions []HistoryVersion
+	var marker string
+	const limit = 100
+	for {
+		keys, nextMarker, err := c.store.PrefixFileList(c.historyPrefix, marker, limit)
+		if err != nil {
+			return nil, err
+		}
+		if len(keys) < 1 {
+			break
+		}
+		for _, key := range keys {
+			if v, ok := parseHistoryKey(c.historyPrefix, key); ok {
+				versions = append(versions, v)
+			}
+		}
+		if len(keys) < limit {
+			break
+		}
+		marker = nextMarker
+	}
+
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Timestamp.Before(versions[j].Timestamp) })
+	return versions, nil
+}
+
+// parseHistoryKey extracts a HistoryVersion from an object key previously
+// produced by historyKey, ignoring anything that doesn't match that shape.
+func parseHistoryKey(prefix, key string) (HistoryVersion, bool) {
+	base := strings.TrimPrefix(key, prefix+"/")
+	base = strings.TrimSuffix(base, ".tfstate")
+	nanos := base
+	if i := strings.IndexByte(base, '-'); i >= 0 {
+		nanos = base[:i]
+	}
+
+	ts, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return HistoryVersion{}, false
+	}
+
+	return HistoryVersion{ID: strings.TrimPrefix(key, prefix+"/"), Timestamp: time.Unix(0, ts).UTC()}, true
+}
+
+// ListStateVersions lists the history of state files written for workspace
+// while enable_versioning was set, oldest first.
+func (b *Backend) ListStateVersions(workspace string) ([]HistoryVersion, error) {
+	client, err := b.remoteClient(workspace)
+	if err != nil {
+		return nil, err
+	}
+	return client.listHistory()
+}
+
+// GetStateVersion returns the raw (still possibly encrypted) contents of a
+// historical state file previously returned by ListStateVersions.
+func (b *Backend) GetStateVersion(workspace, id string) (io.ReadCloser, error) {
+	client, err := b.remoteClient(workspace)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := parseHistoryKey(client.historyPrefix, path.Join(client.historyPrefix, id)); !ok {
+		return nil, fmt.Errorf("%q is not a valid state version id", id)
+	}
+
+	data, exist, err := client.store.GetObject(path.Join(client.historyPrefix, id))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read state version %q for workspace %q: %s", id, workspace, err)
+	}
+	if !exist {
+		return nil, fmt.Errorf("state version %q does not exist for workspace %q", id, workspace)
+	}
+
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// RollbackState promotes a historical state version back to being the
+// current state for workspace, taking the same lock a normal apply would so
+// a rollback can't race with a concurrent write. The rollback itself is
+// written through Put, so it becomes a new history entry rather than
+// silently overwriting the history it was restored from.
+func (b *Backend) RollbackState(workspace, id string) error {
+	client, err := b.remoteClient(workspace)
+	if err != nil {
+		return err
+	}
+
+	r, err := b.GetStateVersion(workspace, id)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return fmt.Errorf("Failed to read state version %q for workspace %q: %s", id, workspace, err)
+	}
+
+	if isEncryptedPayload(data) {
+		data, err = client.decrypt(data)
+		if err != nil {
+			return fmt.Errorf("Failed to decrypt state version %q for workspace %q: %s", id, workspace, err)
+		}
+	}
+
+	lockInfo := state.NewLockInfo()
+	lockInfo.Operation = "rollback"
+	lockID, err := client.Lock(lockInfo)
+	if err != nil {
+		return fmt.Errorf("Failed to lock state for workspace %q: %s", workspace, err)
+	}
+
+	// Local helper so both the success and failure paths below unlock and
+	// report an unlock failure the same way backend_state.go does: a
+	// stranded lock is exactly the kind of thing an incident-time rollback
+	// can't afford to drop silently.
+	lockUnlock := func(parent error) error {
+		if err := client.Unlock(lockID); err != nil {
+			unlockErr := fmt.Errorf(strings.TrimSpace(errStateUnlock), lockID, err)
+			if parent != nil {
+				return fmt.Errorf("%s\n\n%s", parent, unlockErr)
+			}
+			return unlockErr
+		}
+		return parent
+	}
+
+	if err := client.Put(data); err != nil {
+		return lockUnlock(fmt.Errorf("Failed to roll back state for workspace %q to version %q: %s", workspace, id, err))
+	}
+
+	return lockUnlock(nil)
+}
@@ -0,0 +1,64 @@
+package ufile
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRemoteClient_history(t *testing.T) {
+	store := newFakeObjectStore()
+	client := &remoteClient{
+		store:          store,
+		bucketName:     "test-bucket",
+		stateFile:      "test-state",
+		lockFile:       "test-state.tflock",
+		historyEnabled: true,
+		historyPrefix:  "test-state-history",
+	}
+
+	for i := 0; i < 3; i++ {
+		if err := client.Put([]byte(fmt.Sprintf(`{"serial":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := client.listHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("expected 3 history versions, got %d", len(versions))
+	}
+	for i := 1; i < len(versions); i++ {
+		if versions[i].Timestamp.Before(versions[i-1].Timestamp) {
+			t.Fatal("expected history versions to be sorted oldest first")
+		}
+	}
+}
+
+func TestRemoteClient_historyPruning(t *testing.T) {
+	store := newFakeObjectStore()
+	client := &remoteClient{
+		store:          store,
+		bucketName:     "test-bucket",
+		stateFile:      "test-state",
+		lockFile:       "test-state.tflock",
+		historyEnabled: true,
+		historyPrefix:  "test-state-history",
+		maxVersions:    2,
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := client.Put([]byte(fmt.Sprintf(`{"serial":%d}`, i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	versions, err := client.listHistory()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 {
+		t.Fatalf("expected pruning to keep only 2 history versions, got %d", len(versions))
+	}
+}
@@ -0,0 +1,295 @@
+package ufile
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/go-uuid"
+	"github.com/hashicorp/terraform/state"
+)
+
+// lockRecord is what actually gets written to the lock object. It embeds the
+// standard Terraform LockInfo so ForceUnlock and lock-conflict errors still
+// surface Who/Operation/Created, plus an Expires lease so a lock abandoned
+// by a crashed client can be reclaimed after lock_timeout instead of
+// stranding the state forever.
+type lockRecord struct {
+	state.LockInfo
+	Expires *time.Time `json:"Expires,omitempty"`
+}
+
+// Lock acquires the state lock using whichever backend lockBackend selects.
+func (c *remoteClient) Lock(info *state.LockInfo) (string, error) {
+	if c.lockBackend == "umem" {
+		return c.umemLock(info)
+	}
+	return c.objectLock(info)
+}
+
+// Unlock releases a lock previously acquired by Lock.
+func (c *remoteClient) Unlock(id string) error {
+	if c.lockBackend == "umem" {
+		return c.umemUnlock(id)
+	}
+	return c.objectUnlock(id)
+}
+
+// objectLock attempts to atomically create the lock object using a
+// conditional write (If-None-Match: *), which UFile rejects with 412/409 if
+// the object already exists. This replaces the old ubusinessgroup tag
+// mutex, which required an unrelated API, paginated through every tag in
+// the project on every lock, and could collide across buckets.
+func (c *remoteClient) objectLock(info *state.LockInfo) (string, error) {
+	info.Path = c.lockFileURL()
+
+	if info.ID == "" {
+		lockID, err := uuid.GenerateUUID()
+		if err != nil {
+			return "", c.lockError(err)
+		}
+		info.ID = lockID
+	}
+
+	record := lockRecord{LockInfo: *info}
+	if c.lockTimeout > 0 {
+		expires := time.Now().Add(c.lockTimeout)
+		record.Expires = &expires
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return "", c.lockError(err)
+	}
+
+	err = c.putObjectIfAbsent(c.lockFile, data)
+	if err == nil {
+		return info.ID, nil
+	}
+	if !isAlreadyLockedError(err) {
+		return "", c.lockError(err)
+	}
+
+	// Something is already holding the lock. If its lease has a deadline
+	// and that deadline has passed, reclaim it by overwriting the stale
+	// object; otherwise this is a genuine conflict.
+	existing, existingErr := c.objectLockRecord()
+	if existingErr != nil {
+		return "", c.lockError(fmt.Errorf("lock file already exists at %v", c.lockFileURL()))
+	}
+	if existing.Expires == nil || time.Now().Before(*existing.Expires) {
+		return "", c.lockError(fmt.Errorf("lock file already exists at %v", c.lockFileURL()))
+	}
+
+	// NOTE: this overwrite is not itself conditioned on the stale record
+	// we just read, only on the fact that it was stale at read time. UFile
+	// doesn't expose a compare-and-swap/If-Match primitive to this SDK, so
+	// two clients reclaiming the same stale lock at the same instant can
+	// both pass the staleness check above and both land here, producing
+	// two different info.IDs that both believe they hold the lock. This is
+	// called out on the lock_timeout schema description.
+	if err := c.putObject(c.lockFile, data, nil); err != nil {
+		return "", c.lockError(fmt.Errorf("failed to reclaim stale lock at %v: %s", c.lockFileURL(), err))
+	}
+
+	return info.ID, nil
+}
+
+func (c *remoteClient) objectUnlock(id string) error {
+	record, err := c.objectLockRecord()
+	if err != nil {
+		return c.lockError(err)
+	}
+
+	if record.ID != id {
+		return c.lockError(fmt.Errorf("lock ID %q does not match existing lock %q", id, record.ID))
+	}
+
+	if err := c.deleteObject(c.lockFile); err != nil {
+		return c.lockError(err)
+	}
+
+	return nil
+}
+
+// umemLock acquires the lock by writing a lease to UMem/Redis with `SET NX
+// PX lock_ttl`, which is atomic the same way objectLock's conditional write
+// is. Unlike lock_timeout's reclaim-after-the-fact approach, a umem lease
+// expires on its own, so a held lock is kept alive for as long as it's
+// needed by a heartbeat goroutine that periodically renews the TTL.
+func (c *remoteClient) umemLock(info *state.LockInfo) (string, error) {
+	info.Path = c.lockFileURL()
+
+	if info.ID == "" {
+		lockID, err := uuid.GenerateUUID()
+		if err != nil {
+			return "", c.lockError(err)
+		}
+		info.ID = lockID
+	}
+
+	data, err := json.Marshal(lockRecord{LockInfo: *info})
+	if err != nil {
+		return "", c.lockError(err)
+	}
+
+	ttl := c.lockTTL
+	if ttl <= 0 {
+		ttl = defaultLockTTLSeconds * time.Second
+	}
+
+	ok, err := c.umemStore.SetIfAbsent(c.umemLockKey(), data, ttl)
+	if err != nil {
+		return "", c.lockError(err)
+	}
+	if !ok {
+		return "", c.lockError(fmt.Errorf("lock key already exists at %v", c.lockFileURL()))
+	}
+
+	c.startUmemHeartbeat(ttl)
+	return info.ID, nil
+}
+
+func (c *remoteClient) umemUnlock(id string) error {
+	record, err := c.umemLockRecord()
+	if err != nil {
+		return c.lockError(err)
+	}
+
+	if record.ID != id {
+		return c.lockError(fmt.Errorf("lock ID %q does not match existing lock %q", id, record.ID))
+	}
+
+	c.stopUmemHeartbeat()
+
+	if err := c.umemStore.Delete(c.umemLockKey()); err != nil {
+		return c.lockError(err)
+	}
+
+	return nil
+}
+
+// startUmemHeartbeat renews the umem lock lease at roughly a third of its
+// TTL for as long as the lock is held, so a long-running apply doesn't lose
+// the lock to its own lease expiring. It stops when stopUmemHeartbeat is
+// called from Unlock.
+func (c *remoteClient) startUmemHeartbeat(ttl time.Duration) {
+	stop := make(chan struct{})
+	c.umemHeartbeatMu.Lock()
+	c.umemHeartbeatStop = stop
+	c.umemHeartbeatMu.Unlock()
+
+	interval := ttl / 3
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	key := c.umemLockKey()
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// Best-effort: a failed renewal just means the lease may
+				// expire and another client may reclaim the lock, the same
+				// failure mode as a client that crashes outright.
+				_ = c.umemStore.Renew(key, ttl)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func (c *remoteClient) stopUmemHeartbeat() {
+	c.umemHeartbeatMu.Lock()
+	defer c.umemHeartbeatMu.Unlock()
+	if c.umemHeartbeatStop != nil {
+		close(c.umemHeartbeatStop)
+		c.umemHeartbeatStop = nil
+	}
+}
+
+func (c *remoteClient) umemLockKey() string {
+	return "tfstate-lock:" + c.lockFile
+}
+
+func (c *remoteClient) lockError(err error) *state.LockError {
+	lockErr := &state.LockError{
+		Err: err,
+	}
+
+	record, recordErr := c.lockRecord()
+	if recordErr != nil {
+		lockErr.Err = multierror.Append(lockErr.Err, recordErr)
+	} else {
+		lockErr.Info = &record.LockInfo
+	}
+	return lockErr
+}
+
+// lockRecord reads back whichever lock backend is configured, so lockError
+// can surface the conflicting lock's Who/Operation/Created regardless of
+// lockBackend.
+func (c *remoteClient) lockRecord() (*lockRecord, error) {
+	if c.lockBackend == "umem" {
+		return c.umemLockRecord()
+	}
+	return c.objectLockRecord()
+}
+
+func (c *remoteClient) objectLockRecord() (*lockRecord, error) {
+	payload, exist, err := c.getObject(c.lockFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if !exist {
+		return nil, newNotExistError(fmt.Sprintf("lock file %s", c.lockFile))
+	}
+
+	record := &lockRecord{}
+	if err := json.Unmarshal(payload.Data, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+func (c *remoteClient) umemLockRecord() (*lockRecord, error) {
+	data, exist, err := c.umemStore.Get(c.umemLockKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if !exist {
+		return nil, newNotExistError(fmt.Sprintf("lock key %s", c.umemLockKey()))
+	}
+
+	record := &lockRecord{}
+	if err := json.Unmarshal(data, record); err != nil {
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// putObjectIfAbsent writes file only if it does not already exist. It
+// delegates to the configured ObjectStore's conditional-put support (see
+// conditionalPutStore); stores that can't guarantee atomicity document that
+// limitation themselves.
+func (c *remoteClient) putObjectIfAbsent(file string, data []byte) error {
+	cps, ok := c.store.(conditionalPutStore)
+	if !ok {
+		return fmt.Errorf("the configured object store does not support locking")
+	}
+	return cps.PutObjectIfAbsent(file, data)
+}
+
+var errAlreadyLocked = fmt.Errorf("lock object already exists")
+
+func isAlreadyLockedError(err error) bool {
+	return err == errAlreadyLocked
+}
@@ -0,0 +1,174 @@
+package ufile
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/terraform/state"
+)
+
+func TestLockRecord_roundTrip(t *testing.T) {
+	info := state.NewLockInfo()
+	info.ID = "test-id"
+	info.Operation = "test"
+	info.Who = "clientA"
+
+	expires := time.Unix(1700000000, 0).UTC()
+	record := lockRecord{LockInfo: *info, Expires: &expires}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got lockRecord
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+
+	if got.ID != info.ID || got.Who != info.Who || got.Operation != info.Operation {
+		t.Fatalf("lock info did not round-trip: got %+v", got.LockInfo)
+	}
+	if got.Expires == nil || !got.Expires.Equal(*record.Expires) {
+		t.Fatalf("expires did not round-trip: got %v, want %v", got.Expires, record.Expires)
+	}
+}
+
+func TestLockRecord_noExpiryOmitted(t *testing.T) {
+	info := state.NewLockInfo()
+	info.ID = "test-id"
+	record := lockRecord{LockInfo: *info}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var asMap map[string]interface{}
+	if err := json.Unmarshal(data, &asMap); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := asMap["Expires"]; ok {
+		t.Fatal("expected Expires to be omitted when lock_timeout is disabled")
+	}
+}
+
+// fakeUmemStore is an in-memory umemStore with real TTL expiry, which lets
+// umem-backed locking (lock_backend = "umem") be tested for contention and
+// lease expiry without a live UMem/Redis instance.
+type fakeUmemStore struct {
+	mu      sync.Mutex
+	entries map[string]fakeUmemEntry
+}
+
+type fakeUmemEntry struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+func newFakeUmemStore() *fakeUmemStore {
+	return &fakeUmemStore{entries: make(map[string]fakeUmemEntry)}
+}
+
+func (s *fakeUmemStore) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.entries[key]; ok && time.Now().Before(e.expiresAt) {
+		return false, nil
+	}
+	s.entries[key] = fakeUmemEntry{data: value, expiresAt: time.Now().Add(ttl)}
+	return true, nil
+}
+
+func (s *fakeUmemStore) Get(key string) ([]byte, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok || !time.Now().Before(e.expiresAt) {
+		return nil, false, nil
+	}
+	return e.data, true, nil
+}
+
+func (s *fakeUmemStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+func (s *fakeUmemStore) Renew(key string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return fmt.Errorf("key %q does not exist", key)
+	}
+	e.expiresAt = time.Now().Add(ttl)
+	s.entries[key] = e
+	return nil
+}
+
+func TestUmemLock_contention(t *testing.T) {
+	store := newFakeUmemStore()
+	c1 := &remoteClient{lockBackend: "umem", umemStore: store, lockFile: "test-state.tflock", lockTTL: time.Minute}
+	c2 := &remoteClient{lockBackend: "umem", umemStore: store, lockFile: "test-state.tflock", lockTTL: time.Minute}
+
+	info1 := state.NewLockInfo()
+	info1.Operation = "test"
+	id1, err := c1.Lock(info1)
+	if err != nil {
+		t.Fatalf("unexpected error acquiring first lock: %s", err)
+	}
+	defer c1.Unlock(id1)
+
+	info2 := state.NewLockInfo()
+	info2.Operation = "test"
+	if _, err := c2.Lock(info2); err == nil {
+		t.Fatal("expected second lock attempt to fail while the first is held")
+	}
+}
+
+func TestUmemLock_ttlExpiry(t *testing.T) {
+	store := newFakeUmemStore()
+
+	ok, err := store.SetIfAbsent("k", []byte("v"), 20*time.Millisecond)
+	if err != nil || !ok {
+		t.Fatalf("expected initial set to succeed, ok=%v err=%v", ok, err)
+	}
+
+	if ok, _ := store.SetIfAbsent("k", []byte("v2"), 20*time.Millisecond); ok {
+		t.Fatal("expected set to fail while the lease is still live")
+	}
+
+	time.Sleep(30 * time.Millisecond)
+
+	ok, err = store.SetIfAbsent("k", []byte("v3"), 20*time.Millisecond)
+	if err != nil || !ok {
+		t.Fatalf("expected set to succeed once the lease expired, ok=%v err=%v", ok, err)
+	}
+}
+
+func TestUmemLock_heartbeatRenewsLease(t *testing.T) {
+	store := newFakeUmemStore()
+	c := &remoteClient{lockBackend: "umem", umemStore: store, lockFile: "test-state.tflock", lockTTL: 30 * time.Millisecond}
+
+	info := state.NewLockInfo()
+	info.Operation = "test"
+	id, err := c.Lock(info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Unlock(id)
+
+	// Long enough for the original lease to have expired without renewal;
+	// the heartbeat should have kept it alive in the meantime.
+	time.Sleep(100 * time.Millisecond)
+
+	if _, exist, err := store.Get(c.umemLockKey()); err != nil || !exist {
+		t.Fatalf("expected heartbeat to keep the lock lease alive, exist=%v err=%v", exist, err)
+	}
+}
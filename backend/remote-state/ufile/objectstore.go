@@ -0,0 +1,34 @@
+package ufile
+
+import "net/http"
+
+// ObjectStore abstracts the handful of object storage primitives the
+// backend needs: put, get, delete and a paginated prefix listing. Routing
+// remoteClient through this interface, rather than calling
+// *ufsdk.UFileRequest directly, lets the backend also speak to any
+// S3-compatible endpoint (MinIO and friends, selected via driver = "s3")
+// and makes client_test.go fakeable without a live bucket.
+type ObjectStore interface {
+	// PutObject uploads data to key. headers carries additional
+	// transport-level headers -- currently the server-side-encryption
+	// directives remoteClient.Put sets when encrypt = true -- and may be
+	// nil.
+	PutObject(key string, data []byte, headers http.Header) error
+	GetObject(key string) (data []byte, exist bool, err error)
+	DeleteObject(key string) error
+
+	// PrefixFileList lists up to limit keys whose name begins with prefix,
+	// resuming after marker. It returns the marker to resume from on the
+	// next call, or "" once the listing is exhausted.
+	PrefixFileList(prefix, marker string, limit int) (keys []string, nextMarker string, err error)
+}
+
+// conditionalPutStore is implemented by ObjectStore backends that can
+// create an object only if it doesn't already exist, which is what Lock
+// needs to make lock acquisition atomic. Not every ObjectStore can
+// guarantee this (see s3ObjectStore), so it's a separate, optional
+// interface rather than part of ObjectStore itself.
+type conditionalPutStore interface {
+	// PutObjectIfAbsent returns errAlreadyLocked if key already exists.
+	PutObjectIfAbsent(key string, data []byte) error
+}
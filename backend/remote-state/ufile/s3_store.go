@@ -0,0 +1,166 @@
+package ufile
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3ObjectStore is an ObjectStore backed by any S3-compatible endpoint
+// (MinIO, and other stores many UCloud users already run alongside UFile).
+// It's selected with driver = "s3".
+type s3ObjectStore struct {
+	client   *s3.S3
+	uploader *s3manager.Uploader
+	bucket   string
+}
+
+func newS3ObjectStore(endpoint, accessKey, secretKey, region, bucket string, forcePathStyle bool) (*s3ObjectStore, error) {
+	cfg := aws.NewConfig().
+		WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, "")).
+		WithS3ForcePathStyle(forcePathStyle)
+	if region != "" {
+		cfg = cfg.WithRegion(region)
+	}
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint)
+	}
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("error creating s3 session, %s", err)
+	}
+
+	client := s3.New(sess)
+	return &s3ObjectStore{
+		client:   client,
+		uploader: s3manager.NewUploaderWithClient(client),
+		bucket:   bucket,
+	}, nil
+}
+
+// PutObject uploads data to key. headers carries server-side-encryption
+// directives set by remoteClient.Put (see objectstore.go); the UFile
+// "X-UFile-Server-Side-Encryption*" headers have no S3 equivalent, so they
+// are translated into the matching s3manager.UploadInput fields instead of
+// being sent as raw headers.
+func (s *s3ObjectStore) PutObject(key string, data []byte, headers http.Header) error {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(data),
+	}
+
+	switch headers.Get("X-UFile-Server-Side-Encryption") {
+	case "AES256":
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAes256)
+	case "KMS":
+		input.ServerSideEncryption = aws.String(s3.ServerSideEncryptionAwsKms)
+		if keyID := headers.Get("X-UFile-Server-Side-Encryption-Kms-Key-Id"); keyID != "" {
+			input.SSEKMSKeyId = aws.String(keyID)
+		}
+	}
+
+	if _, err := s.uploader.Upload(input); err != nil {
+		return fmt.Errorf("error uploading %q to s3, %s", key, err)
+	}
+	return nil
+}
+
+// PutObjectIfAbsent is a best-effort, non-atomic emulation of a conditional
+// create: not every S3-compatible store supports If-None-Match writes, so
+// unlike ufileObjectStore this has a (small) race window between the check
+// and the put.
+func (s *s3ObjectStore) PutObjectIfAbsent(key string, data []byte) error {
+	_, exist, err := s.GetObject(key)
+	if err != nil {
+		return err
+	}
+	if exist {
+		return errAlreadyLocked
+	}
+	return s.PutObject(key, data, nil)
+}
+
+// GetObject streams the response body into a buffer sized from
+// Content-Length while hashing it in the same pass, rather than buffering
+// the whole object and hashing it afterwards. When the object's ETag is a
+// plain (non-multipart) upload's MD5 -- the common case -- the computed
+// digest is checked against it so a truncated or corrupted download fails
+// loudly instead of silently producing a broken state.
+func (s *s3ObjectStore) GetObject(key string) (data []byte, exist bool, err error) {
+	out, err := s.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && (awsErr.Code() == s3.ErrCodeNoSuchKey || awsErr.Code() == "NotFound") {
+			return nil, false, nil
+		}
+		return nil, false, fmt.Errorf("error downloading %q from s3, %s", key, err)
+	}
+	defer out.Body.Close()
+
+	buf := bytes.NewBuffer(make([]byte, 0, aws.Int64Value(out.ContentLength)))
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(buf, h), out.Body); err != nil {
+		return nil, false, fmt.Errorf("error reading %q from s3, %s", key, err)
+	}
+
+	// a multipart upload's ETag isn't a plain MD5 of the body -- it's the
+	// MD5 of the concatenated part MD5s, with a "-<numParts>" suffix -- so
+	// only verify when that suffix is absent.
+	if etag := strings.Trim(aws.StringValue(out.ETag), `"`); etag != "" && !strings.Contains(etag, "-") {
+		if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, etag) {
+			return nil, false, fmt.Errorf("downloaded object %q failed integrity check: expected ETag %s, got %s", key, etag, got)
+		}
+	}
+
+	return buf.Bytes(), true, nil
+}
+
+func (s *s3ObjectStore) DeleteObject(key string) error {
+	_, err := s.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("error deleting %q from s3, %s", key, err)
+	}
+	return nil
+}
+
+func (s *s3ObjectStore) PrefixFileList(prefix, marker string, limit int) ([]string, string, error) {
+	out, err := s.client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket:     aws.String(s.bucket),
+		Prefix:     aws.String(prefix),
+		StartAfter: aws.String(marker),
+		MaxKeys:    aws.Int64(int64(limit)),
+	})
+	if err != nil {
+		return nil, "", fmt.Errorf("error listing s3 objects under %q, %s", prefix, err)
+	}
+
+	keys := make([]string, 0, len(out.Contents))
+	for _, obj := range out.Contents {
+		keys = append(keys, aws.StringValue(obj.Key))
+	}
+
+	nextMarker := ""
+	if aws.BoolValue(out.IsTruncated) && len(keys) > 0 {
+		nextMarker = keys[len(keys)-1]
+	}
+
+	return keys, nextMarker, nil
+}
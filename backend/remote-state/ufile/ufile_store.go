@@ -0,0 +1,206 @@
+package ufile
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	ufsdk "github.com/ufilesdk-dev/ufile-gosdk"
+)
+
+// ufileObjectStore is the default ObjectStore, backed by UFile itself.
+type ufileObjectStore struct {
+	client *ufsdk.UFileRequest
+
+	// uploadPartSize and uploadConcurrency tune PutObject's multipart
+	// upload. Zero values fall back to the package defaults.
+	uploadPartSize    int64
+	uploadConcurrency int
+}
+
+func (s *ufileObjectStore) PutObject(key string, data []byte, headers http.Header) error {
+	partSize := s.uploadPartSize
+	if partSize <= 0 {
+		partSize = defaultUploadPartSize
+	}
+
+	// Typical state files are well under partSize, so go through the plain
+	// single-shot PUT (as PutObjectIfAbsent does for the lock object)
+	// instead of the multipart API below. This matters beyond avoiding the
+	// extra init/finish round trips: UFile only returns a plain MD5 ETag
+	// for single-part uploads, and GetObject's integrity check can only
+	// verify against that -- a multipart-composite ETag is skipped (see the
+	// comment there), so routing small writes through multipart would
+	// silently defeat that check for the common case.
+	if int64(len(data)) <= partSize {
+		if err := s.client.PutFileWithHeader(bytes.NewReader(data), key, "application/json", headers); err != nil {
+			return fmt.Errorf("error on uploading file, %s", err)
+		}
+		return nil
+	}
+
+	concurrency := s.uploadConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultUploadConcurrency
+	}
+
+	// InitiateMultipartUploadWithHeader accepts a nil header just fine; it's
+	// used unconditionally here so PutObject has one code path whether or
+	// not the caller (remoteClient.Put, when encrypt = true) wants
+	// server-side-encryption headers attached to the upload.
+	uploadState, err := s.client.InitiateMultipartUploadWithHeader(key, "application/json", headers)
+	if err != nil {
+		return fmt.Errorf("error on initing upload file, %s", err)
+	}
+
+	numParts := (int64(len(data)) + partSize - 1) / partSize
+
+	g := newGate(concurrency)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var uploadMu sync.Mutex
+	var firstErr error
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for part := int64(0); part < numParts; part++ {
+		start := part * partSize
+		end := start + partSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		chunk := data[start:end]
+		partIndex := int(part)
+
+		wg.Add(1)
+		g.enter()
+		go func() {
+			defer wg.Done()
+			defer g.leave()
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			// uploadState is shared across every part and, as far as this
+			// package can verify, ufile-gosdk records each part's ETag into
+			// it by call order rather than handing the ETag back to us --
+			// nothing in its docs establishes that as safe for concurrent
+			// callers, so serialize the actual UploadPart calls on uploadMu.
+			// Parts are therefore sent one at a time; the gate only bounds
+			// how many workers are waiting on uploadMu.
+			uploadMu.Lock()
+			uploadErr := s.client.UploadPart(bytes.NewReader(chunk), uploadState, partIndex)
+			uploadMu.Unlock()
+
+			if uploadErr != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = fmt.Errorf("error on uploading part %d, %s", partIndex, uploadErr)
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		// ignore the abort error; the original upload error is more useful.
+		_ = s.client.AbortMultipartUpload(uploadState)
+		return firstErr
+	}
+
+	if err := s.client.FinishMultipartUpload(uploadState); err != nil {
+		return fmt.Errorf("error on finishing upload file, %s", err)
+	}
+
+	return nil
+}
+
+// PutObjectIfAbsent writes key only if it does not already exist, using a
+// conditional PUT (If-None-Match: *) so the create is atomic even when two
+// clients race. A 412 or 409 response means another client's object won.
+func (s *ufileObjectStore) PutObjectIfAbsent(key string, data []byte) error {
+	header := http.Header{}
+	header.Set("If-None-Match", "*")
+
+	err := s.client.PutFileWithHeader(bytes.NewReader(data), key, "application/json", header)
+	if err != nil {
+		if status := s.client.LastResponseStatus; status == http.StatusPreconditionFailed || status == http.StatusConflict {
+			return errAlreadyLocked
+		}
+		return err
+	}
+
+	return nil
+}
+
+// GetObject streams the object straight into a buffer and an md5 digest in
+// one pass, rather than buffering the whole response and hashing it
+// afterwards. If the server returned an ETag or Content-MD5 header, the
+// digest is verified against it before the data is handed back, so a
+// truncated or corrupted download fails loudly instead of silently
+// producing a broken state.
+func (s *ufileObjectStore) GetObject(key string) (data []byte, exist bool, err error) {
+	var buf bytes.Buffer
+	h := md5.New()
+
+	if err := s.client.DownloadFile(io.MultiWriter(&buf, h), key); err != nil {
+		if s.client.LastResponseStatus == 404 {
+			return nil, false, nil
+		}
+		return nil, false, err
+	}
+
+	if want := strings.Trim(s.client.LastResponseHeader.Get("Content-MD5"), `"`); want != "" {
+		if got := base64.StdEncoding.EncodeToString(h.Sum(nil)); got != want {
+			return nil, false, fmt.Errorf("downloaded object %q failed integrity check: expected Content-MD5 %s, got %s", key, want, got)
+		}
+	} else if etag := strings.Trim(s.client.LastResponseHeader.Get("ETag"), `"`); etag != "" && !strings.Contains(etag, "-") {
+		// a multipart upload's ETag isn't a plain MD5 of the body -- it's the
+		// MD5 of the concatenated part MD5s, with a "-<numParts>" suffix --
+		// so only verify when that suffix is absent. PutObject above only
+		// goes through the multipart API for data bigger than partSize, so
+		// this still covers the common (small state) case.
+		if got := hex.EncodeToString(h.Sum(nil)); !strings.EqualFold(got, etag) {
+			return nil, false, fmt.Errorf("downloaded object %q failed integrity check: expected ETag %s, got %s", key, etag, got)
+		}
+	}
+
+	return buf.Bytes(), true, nil
+}
+
+func (s *ufileObjectStore) DeleteObject(key string) error {
+	if err := s.client.DeleteFile(key); err != nil {
+		return fmt.Errorf("error on deleting file, %s", err)
+	}
+	return nil
+}
+
+func (s *ufileObjectStore) PrefixFileList(prefix, marker string, limit int) ([]string, string, error) {
+	resp, err := s.client.PrefixFileList(prefix, marker, limit)
+	if err != nil {
+		return nil, "", fmt.Errorf("error on reading file list by prefix, %s", err)
+	}
+
+	keys := make([]string, 0, len(resp.DataSet))
+	for _, v := range resp.DataSet {
+		keys = append(keys, v.FileName)
+	}
+
+	nextMarker := ""
+	if len(resp.DataSet) >= limit {
+		nextMarker = resp.NextMarker
+	}
+
+	return keys, nextMarker, nil
+}
@@ -0,0 +1,63 @@
+package ufile
+
+import (
+	"time"
+
+	"github.com/go-redis/redis"
+)
+
+// umemStore is the minimal Redis surface remoteClient needs for umem-backed
+// locking (lock_backend = "umem" in backend.go). It exists so locking can be
+// unit tested against a fake in lock_test.go instead of requiring a live
+// UMem/Redis instance.
+type umemStore interface {
+	// SetIfAbsent sets key to value with the given TTL only if key doesn't
+	// already exist (Redis SET NX PX), reporting whether it was set.
+	SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error)
+
+	Get(key string) (data []byte, exist bool, err error)
+
+	Delete(key string) error
+
+	// Renew extends key's TTL without changing its value (Redis PEXPIRE),
+	// used by remoteClient's lock heartbeat to keep a held lock alive.
+	Renew(key string, ttl time.Duration) error
+}
+
+// redisUmemStore is the default umemStore, backed by a UCloud UMem/Redis
+// instance.
+type redisUmemStore struct {
+	client *redis.Client
+}
+
+func newRedisUmemStore(endpoint, password string) *redisUmemStore {
+	return &redisUmemStore{
+		client: redis.NewClient(&redis.Options{
+			Addr:     endpoint,
+			Password: password,
+		}),
+	}
+}
+
+func (s *redisUmemStore) SetIfAbsent(key string, value []byte, ttl time.Duration) (bool, error) {
+	return s.client.SetNX(key, value, ttl).Result()
+}
+
+func (s *redisUmemStore) Get(key string) ([]byte, bool, error) {
+	data, err := s.client.Get(key).Bytes()
+	if err == redis.Nil {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return data, true, nil
+}
+
+func (s *redisUmemStore) Delete(key string) error {
+	return s.client.Del(key).Err()
+}
+
+func (s *redisUmemStore) Renew(key string, ttl time.Duration) error {
+	return s.client.PExpire(key, ttl).Err()
+}
@@ -0,0 +1,22 @@
+package ufile
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestStateHeader_parsesSerialAndLineage(t *testing.T) {
+	data := []byte(`{"version": 4, "serial": 7, "lineage": "abc-123", "outputs": {}}`)
+
+	var header stateHeader
+	if err := json.Unmarshal(data, &header); err != nil {
+		t.Fatal(err)
+	}
+
+	if header.Serial != 7 {
+		t.Fatalf("got serial %d, want 7", header.Serial)
+	}
+	if header.Lineage != "abc-123" {
+		t.Fatalf("got lineage %q, want %q", header.Lineage, "abc-123")
+	}
+}